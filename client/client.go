@@ -2,29 +2,124 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	// Default chunk size for download test (1 MiB)
 	defaultChunkSize = 1048576
-	// Default number of chunks for download test
-	defaultChunks = 4
-	// Default timeout for HTTP requests
-	defaultTimeout = 10 * time.Second
+	// maxCkSizeChunks is the largest ckSize the librespeed garbage endpoint accepts
+	maxCkSizeChunks = 1024
+	// earthRadiusKm is the mean radius of the Earth used for haversine distance
+	earthRadiusKm = 6371.0
+	// progressSampleInterval is how often ProgressFunc is invoked during a test
+	progressSampleInterval = 100 * time.Millisecond
 )
 
+// ProgressFunc is called periodically while a download/upload test runs.
+// phase is "download" or "upload", currentMbps is the throughput measured
+// since the test started, and elapsed is the number of seconds elapsed.
+type ProgressFunc func(phase string, currentMbps, elapsed float64)
+
+// TestConfig controls the duration, parallelism and warmup behavior of the
+// download and upload tests.
+type TestConfig struct {
+	Duration  time.Duration // total wall-clock time to run the test for
+	Parallel  int           // number of concurrent HTTP streams
+	Warmup    time.Duration // leading time excluded from the speed calculation
+	ChunkSize int           // size in bytes of each upload chunk; translated to a 1 MiB-chunk count for download requests (see ckSizeChunks)
+}
+
+// DefaultTestConfig returns the TestConfig used when RunTest is not given one.
+func DefaultTestConfig() TestConfig {
+	return TestConfig{
+		Duration:  15 * time.Second,
+		Parallel:  4,
+		Warmup:    2 * time.Second,
+		ChunkSize: defaultChunkSize,
+	}
+}
+
 // Client represents a librespeed client
 type Client struct {
-	baseURL    string
-	httpClient *http.Client
+	baseURL      string
+	httpClient   *http.Client
+	progressFunc ProgressFunc
+}
+
+// WithProgress registers a callback invoked with live throughput samples
+// while a download or upload test is in progress.
+func (c *Client) WithProgress(fn ProgressFunc) *Client {
+	c.progressFunc = fn
+	return c
+}
+
+// WithTransport replaces the client's HTTP transport, e.g. to bind tests to
+// a specific source interface via a custom net.Dialer, run them through a
+// proxy, or inject a mock RoundTripper in tests.
+func (c *Client) WithTransport(rt http.RoundTripper) *Client {
+	c.httpClient.Transport = rt
+	return c
+}
+
+// WithHTTP2 enables or disables HTTP/2 negotiation on the client's
+// transport. Forcing HTTP/1.1 (by disabling it) produces very different
+// throughput numbers than default HTTP/2 multiplexing, which matters when
+// benchmarking CDNs that behave differently per protocol. It only has an
+// effect when the transport is an *http.Transport.
+func (c *Client) WithHTTP2(enabled bool) *Client {
+	t := c.transport()
+	if t == nil {
+		return c
+	}
+
+	if enabled {
+		t.ForceAttemptHTTP2 = true
+		t.TLSNextProto = nil
+	} else {
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(authority string, c *tls.Conn) http.RoundTripper{}
+	}
+
+	return c
+}
+
+// WithKeepAlives enables or disables HTTP connection reuse on the client's
+// transport. It only has an effect when the transport is an *http.Transport.
+func (c *Client) WithKeepAlives(enabled bool) *Client {
+	t := c.transport()
+	if t == nil {
+		return c
+	}
+
+	t.DisableKeepAlives = !enabled
+	return c
+}
+
+// transport returns the client's *http.Transport, creating a default one
+// (cloned from http.DefaultTransport) if none has been set yet. It returns
+// nil if the client was given a custom http.RoundTripper that isn't an
+// *http.Transport, since there's nothing to tune in that case.
+func (c *Client) transport() *http.Transport {
+	if c.httpClient.Transport == nil {
+		c.httpClient.Transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	t, _ := c.httpClient.Transport.(*http.Transport)
+	return t
 }
 
 // Result represents the speed test results
@@ -35,50 +130,341 @@ type Result struct {
 	Jitter        float64 // in ms
 	ISP           string
 	IP            string
+	Log           []TelemetrySample // per-phase samples collected during the test, for SubmitTelemetry
+	PingSamples   []PingSample      // per-sample ping breakdown collected during the ping test
 }
 
-// NewClient creates a new librespeed client
+// TelemetrySample is one data point collected while a test phase ran.
+type TelemetrySample struct {
+	Type      string  `json:"type"`      // "ping", "download", or "upload"
+	Timestamp float64 `json:"timestamp"` // seconds since that phase started for download/upload; the sample's index for ping
+	Value     float64 `json:"value"`     // Mbps for download/upload, RTT in ms for ping
+}
+
+// NewClient creates a new librespeed client. The returned client's
+// http.Client has no whole-request Timeout: download/upload requests are
+// long-lived by design (see TestConfig.Duration), so callers bound request
+// lifetime with the context.Context passed to RunTest and friends instead.
 func NewClient(baseURL string) *Client {
 	// Ensure baseURL doesn't end with a slash
 	baseURL = strings.TrimRight(baseURL, "/")
 
 	return &Client{
-		baseURL: baseURL,
-		httpClient: &http.Client{
-			Timeout: defaultTimeout,
-		},
+		baseURL:    baseURL,
+		httpClient: &http.Client{},
+	}
+}
+
+// Server describes a librespeed backend as listed in a servers.json feed.
+type Server struct {
+	Name      string  // human-readable label, e.g. "Frankfurt, Germany"
+	Server    string  // base URL the other fields are relative to
+	DLURL     string  // path to request download garbage from
+	ULURL     string  // path to POST upload data to
+	PingURL   string  // path used for ping/jitter measurement
+	GetIPURL  string  // path that returns caller IP/ISP info
+	Lat       float64 // latitude in degrees, valid only if HasCoords
+	Lon       float64 // longitude in degrees, valid only if HasCoords
+	HasCoords bool    // whether the feed supplied lat/lon for this server
+}
+
+// rawServer mirrors the on-the-wire servers.json schema, where lat/lon may be
+// absent, numeric, or quoted strings depending on the feed.
+type rawServer struct {
+	Name     string          `json:"name"`
+	Server   string          `json:"server"`
+	DLURL    string          `json:"dlURL"`
+	ULURL    string          `json:"ulURL"`
+	PingURL  string          `json:"pingURL"`
+	GetIPURL string          `json:"getIpURL"`
+	Lat      json.RawMessage `json:"lat,omitempty"`
+	Lon      json.RawMessage `json:"lon,omitempty"`
+}
+
+// urlFor joins the server's base URL with one of its relative endpoint paths.
+func (s *Server) urlFor(path string) string {
+	return strings.TrimRight(s.Server, "/") + "/" + strings.TrimLeft(path, "/")
+}
+
+// DiscoverServers fetches and parses a librespeed servers.json feed.
+func (c *Client) DiscoverServers(ctx context.Context, listURL string) ([]Server, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, listURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build server list request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch server list: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server list request failed with status: %d", resp.StatusCode)
+	}
+
+	var raw []rawServer
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("failed to decode server list: %w", err)
+	}
+
+	servers := make([]Server, 0, len(raw))
+	for _, r := range raw {
+		lat, latOK := parseCoord(r.Lat)
+		lon, lonOK := parseCoord(r.Lon)
+		servers = append(servers, Server{
+			Name:      r.Name,
+			Server:    r.Server,
+			DLURL:     r.DLURL,
+			ULURL:     r.ULURL,
+			PingURL:   r.PingURL,
+			GetIPURL:  r.GetIPURL,
+			Lat:       lat,
+			Lon:       lon,
+			HasCoords: latOK && lonOK,
+		})
+	}
+
+	return servers, nil
+}
+
+// parseCoord decodes a lat/lon field that may be a JSON number or a quoted string.
+func parseCoord(raw json.RawMessage) (float64, bool) {
+	if len(raw) == 0 {
+		return 0, false
+	}
+
+	var f float64
+	if err := json.Unmarshal(raw, &f); err == nil {
+		return f, true
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+			return f, true
+		}
+	}
+
+	return 0, false
+}
+
+// LocateCaller resolves the caller's approximate coordinates by querying a
+// bootstrap server's getIP endpoint and parsing the location in its ISP info.
+func (c *Client) LocateCaller(ctx context.Context, bootstrapURL string) (lat, lon float64, err error) {
+	geoURL := fmt.Sprintf("%s/getIP?isp=true&distance=mi", strings.TrimRight(bootstrapURL, "/"))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, geoURL, nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to build locate request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to locate caller: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("locate request failed with status: %d", resp.StatusCode)
+	}
+
+	var ipInfo IPInfo
+	if err := json.NewDecoder(resp.Body).Decode(&ipInfo); err != nil {
+		return 0, 0, fmt.Errorf("failed to decode locate response: %w", err)
+	}
+
+	return parseLocation(ipInfo.RawISPInfo.Location)
+}
+
+// parseLocation parses the "lat, lon" string exposed in RawISPInfo.Location.
+func parseLocation(loc string) (lat, lon float64, err error) {
+	parts := strings.Split(loc, ",")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("unexpected location format: %q", loc)
+	}
+
+	lat, err = strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid latitude in location %q: %w", loc, err)
+	}
+
+	lon, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid longitude in location %q: %w", loc, err)
+	}
+
+	return lat, lon, nil
+}
+
+// haversineKm returns the great-circle distance in km between two WGS84
+// coordinates given in degrees.
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	phi1 := lat1 * math.Pi / 180
+	phi2 := lat2 * math.Pi / 180
+	deltaPhi := (lat2 - lat1) * math.Pi / 180
+	deltaLambda := (lon2 - lon1) * math.Pi / 180
+
+	a := math.Sin(deltaPhi/2)*math.Sin(deltaPhi/2) +
+		math.Cos(phi1)*math.Cos(phi2)*math.Sin(deltaLambda/2)*math.Sin(deltaLambda/2)
+	c := 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+
+	return earthRadiusKm * c
+}
+
+// SelectNearest picks the server closest to (lat, lon) out of servers that
+// carry coordinates. If none of them do, it falls back to ranking every
+// server by measured latency to its PingURL.
+func (c *Client) SelectNearest(ctx context.Context, servers []Server, lat, lon float64) (*Server, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no servers to choose from")
+	}
+
+	var best *Server
+	bestDist := math.MaxFloat64
+	for i := range servers {
+		if !servers[i].HasCoords {
+			continue
+		}
+		d := haversineKm(lat, lon, servers[i].Lat, servers[i].Lon)
+		if d < bestDist {
+			bestDist = d
+			best = &servers[i]
+		}
+	}
+
+	if best != nil {
+		return best, nil
+	}
+
+	return c.selectByLatency(ctx, servers)
+}
+
+// selectByLatency ranks servers with no usable coordinates by probing their
+// PingURL and picking the one with the lowest round-trip time.
+func (c *Client) selectByLatency(ctx context.Context, servers []Server) (*Server, error) {
+	var best *Server
+	bestLatency := time.Duration(math.MaxInt64)
+
+	for i := range servers {
+		latency, err := c.probeLatency(ctx, &servers[i])
+		if err != nil {
+			continue
+		}
+		if latency < bestLatency {
+			bestLatency = latency
+			best = &servers[i]
+		}
+	}
+
+	if best == nil {
+		return nil, fmt.Errorf("failed to reach any server to rank by latency")
+	}
+
+	return best, nil
+}
+
+// probeLatency measures the round-trip time of a single HEAD (falling back
+// to GET) request against a server's PingURL.
+func (c *Client) probeLatency(ctx context.Context, s *Server) (time.Duration, error) {
+	pingURL := s.urlFor(s.PingURL)
+
+	start := time.Now()
+	if req, err := http.NewRequestWithContext(ctx, http.MethodHead, pingURL, nil); err == nil {
+		if resp, err := c.httpClient.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return time.Since(start), nil
+			}
+		}
+	}
+
+	// Some backends don't support HEAD; retry with GET.
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pingURL, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start = time.Now()
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("ping probe failed with status: %d", resp.StatusCode)
+	}
+
+	return time.Since(start), nil
+}
+
+// defaultServer builds a Server from the client's baseURL using the legacy
+// fixed paths, so RunTest keeps working for callers that skip discovery.
+func (c *Client) defaultServer() *Server {
+	return &Server{
+		Server:   c.baseURL,
+		DLURL:    "garbage",
+		ULURL:    "empty",
+		PingURL:  "empty",
+		GetIPURL: "getIP",
 	}
 }
 
-// RunTest performs a complete speed test
-func (c *Client) RunTest() (*Result, error) {
+// RunTest performs a complete speed test against the given server, using cfg
+// to control the duration and parallelism of the download/upload phases. If
+// server is nil, the client's own baseURL is used with the legacy fixed
+// paths; if cfg is the zero value, DefaultTestConfig is used.
+func (c *Client) RunTest(ctx context.Context, server *Server, cfg TestConfig) (*Result, error) {
+	if server == nil {
+		server = c.defaultServer()
+	}
+	if cfg.Duration == 0 {
+		cfg = DefaultTestConfig()
+	}
+
 	result := &Result{}
 
 	// Get IP and ISP info first
-	ipInfo, err := c.getIPInfo()
+	ipInfo, err := c.getIPInfo(ctx, server)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get IP info: %w", err)
 	}
 	result.IP = ipInfo.ProcessedString
 	result.ISP = ipInfo.RawISPInfo.Organization
 
+	// Capture throughput samples reported via the progress callback, in
+	// addition to forwarding them to any callback the caller installed.
+	origProgress := c.progressFunc
+	defer func() { c.progressFunc = origProgress }()
+	c.progressFunc = func(phase string, currentMbps, elapsed float64) {
+		result.Log = append(result.Log, TelemetrySample{Type: phase, Timestamp: elapsed, Value: currentMbps})
+		if origProgress != nil {
+			origProgress(phase, currentMbps, elapsed)
+		}
+	}
+
 	// Run ping test
-	ping, jitter, err := c.pingTest()
+	ping, jitter, pingSamples, err := c.pingTest(ctx, server)
 	if err != nil {
 		return nil, fmt.Errorf("ping test failed: %w", err)
 	}
 	result.Ping = ping
 	result.Jitter = jitter
+	result.PingSamples = pingSamples
+	for i, s := range pingSamples {
+		result.Log = append(result.Log, TelemetrySample{Type: "ping", Timestamp: float64(i), Value: s.Total})
+	}
 
 	// Run download test
-	downloadSpeed, err := c.downloadTest()
+	downloadSpeed, err := c.downloadTest(ctx, server, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("download test failed: %w", err)
 	}
 	result.DownloadSpeed = downloadSpeed
 
 	// Run upload test
-	uploadSpeed, err := c.uploadTest()
+	uploadSpeed, err := c.uploadTest(ctx, server, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("upload test failed: %w", err)
 	}
@@ -87,109 +473,307 @@ func (c *Client) RunTest() (*Result, error) {
 	return result, nil
 }
 
-// downloadTest performs a download speed test
-func (c *Client) downloadTest() (float64, error) {
-	start := time.Now()
+// atomicCounter is an io.Writer that atomically tallies the number of bytes
+// written to it, for counting transferred bytes across concurrent streams.
+type atomicCounter struct {
+	n *int64
+}
 
-	// Request garbage data with default chunk size
-	resp, err := c.httpClient.Get(fmt.Sprintf("%s/garbage?ckSize=%d", c.baseURL, defaultChunks))
-	if err != nil {
-		return 0, err
+func (w atomicCounter) Write(p []byte) (int, error) {
+	atomic.AddInt64(w.n, int64(len(p)))
+	return len(p), nil
+}
+
+// bytesToMbps converts a byte count measured over seconds into Mbps.
+func bytesToMbps(bytesCount int64, seconds float64) float64 {
+	if seconds <= 0 {
+		return 0
 	}
-	defer resp.Body.Close()
+	return (float64(bytesCount) * 8) / (1000000 * seconds)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("download test failed with status: %d", resp.StatusCode)
+// runStreams runs cfg.Parallel copies of worker concurrently until cfg.Duration
+// has elapsed or ctx is done, sampling the byte counter every
+// progressSampleInterval and reporting it through c.progressFunc. It returns
+// the Mbps measured over the steady-state window, i.e. excluding the first
+// cfg.Warmup of the test.
+//
+// worker is handed a context scoped to the test's deadline: runStreams
+// cancels it as soon as that deadline (or ctx) is reached, so an in-flight
+// request is severed immediately rather than left to run until some
+// unrelated client-wide timeout fires.
+func (c *Client) runStreams(ctx context.Context, phase string, cfg TestConfig, counter *int64, worker func(ctx context.Context, stop <-chan struct{})) float64 {
+	start := time.Now()
+	deadline := start.Add(cfg.Duration)
+	warmupDeadline := start.Add(cfg.Warmup)
+
+	testCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker(testCtx, stop)
+		}()
 	}
 
-	// Read all data
-	_, err = io.Copy(ioutil.Discard, resp.Body)
-	if err != nil {
-		return 0, err
+	ticker := time.NewTicker(progressSampleInterval)
+	defer ticker.Stop()
+
+	var warmupBytes, finalBytes int64
+	var finalElapsed time.Duration
+	warmupCaptured := false
+
+loop:
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-ctx.Done():
+			now = time.Now()
+		}
+
+		bytesSoFar := atomic.LoadInt64(counter)
+		elapsed := now.Sub(start)
+
+		if !warmupCaptured && !now.Before(warmupDeadline) {
+			warmupBytes = bytesSoFar
+			warmupCaptured = true
+		}
+
+		if c.progressFunc != nil {
+			c.progressFunc(phase, bytesToMbps(bytesSoFar, elapsed.Seconds()), elapsed.Seconds())
+		}
+
+		if !now.Before(deadline) || ctx.Err() != nil {
+			finalBytes = bytesSoFar
+			finalElapsed = elapsed
+			break loop
+		}
 	}
 
-	duration := time.Since(start).Seconds()
-	// Calculate speed in Mbps
-	// Total bytes = chunks * chunkSize
-	totalBytes := float64(defaultChunks * defaultChunkSize)
-	speedMbps := (totalBytes * 8) / (1000000 * duration) // Convert to Mbps
+	// Sever any in-flight requests right away instead of waiting for them to
+	// time out on their own, then let the workers notice and return.
+	cancel()
+	close(stop)
+	wg.Wait()
 
-	return speedMbps, nil
+	if !warmupCaptured {
+		// The test ended before the warmup period elapsed; treat it all as steady-state.
+		return bytesToMbps(finalBytes, finalElapsed.Seconds())
+	}
+
+	steadyElapsed := finalElapsed - cfg.Warmup
+	return bytesToMbps(finalBytes-warmupBytes, steadyElapsed.Seconds())
 }
 
-// uploadTest performs an upload speed test
-func (c *Client) uploadTest() (float64, error) {
-	// Create a buffer with random data
-	data := make([]byte, defaultChunkSize)
-	for i := range data {
-		data[i] = byte(i % 256)
+// ckSizeChunks converts a chunk size in bytes into the "ckSize" query
+// parameter the librespeed garbage endpoint expects: a count of 1 MiB
+// chunks, clamped to the range the endpoint accepts.
+func ckSizeChunks(chunkSize int) int {
+	chunks := chunkSize / defaultChunkSize
+	if chunks < 1 {
+		chunks = 1
+	}
+	if chunks > maxCkSizeChunks {
+		chunks = maxCkSizeChunks
 	}
+	return chunks
+}
 
-	start := time.Now()
+// downloadTest runs a duration-based, multi-stream download speed test
+// against the given server.
+func (c *Client) downloadTest(ctx context.Context, server *Server, cfg TestConfig) (float64, error) {
+	dlURL := fmt.Sprintf("%s?ckSize=%d", server.urlFor(server.DLURL), ckSizeChunks(cfg.ChunkSize))
+
+	var totalBytes int64
+	worker := func(ctx context.Context, stop <-chan struct{}) {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, dlURL, nil)
+			if err != nil {
+				return
+			}
+
+			resp, err := c.httpClient.Do(req)
+			if err != nil {
+				return
+			}
+			io.Copy(atomicCounter{&totalBytes}, resp.Body)
+			resp.Body.Close()
+		}
+	}
 
-	// Upload the data
-	resp, err := c.httpClient.Post(fmt.Sprintf("%s/empty", c.baseURL), "application/octet-stream", bytes.NewReader(data))
-	if err != nil {
-		return 0, err
+	return c.runStreams(ctx, "download", cfg, &totalBytes, worker), nil
+}
+
+// uploadTest runs a duration-based, multi-stream upload speed test against
+// the given server.
+func (c *Client) uploadTest(ctx context.Context, server *Server, cfg TestConfig) (float64, error) {
+	// Create a buffer of repeating 0-255 byte data, reused across requests by each stream
+	data := make([]byte, cfg.ChunkSize)
+	for i := range data {
+		data[i] = byte(i % 256)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("upload test failed with status: %d", resp.StatusCode)
+	ulURL := server.urlFor(server.ULURL)
+
+	var totalBytes int64
+	worker := func(ctx context.Context, stop <-chan struct{}) {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, ulURL, bytes.NewReader(data))
+			if err != nil {
+				return
+			}
+			req.Header.Set("Content-Type", "application/octet-stream")
+
+			resp, err := c.httpClient.Do(req)
+			if err != nil {
+				return
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			atomic.AddInt64(&totalBytes, int64(len(data)))
+		}
 	}
 
-	duration := time.Since(start).Seconds()
-	// Calculate speed in Mbps
-	speedMbps := (float64(len(data)) * 8) / (1000000 * duration)
+	return c.runStreams(ctx, "upload", cfg, &totalBytes, worker), nil
+}
 
-	return speedMbps, nil
+// PingSample is one ping measurement, broken down into the portion of the
+// round trip spent connecting, negotiating TLS, and waiting on the server.
+type PingSample struct {
+	Total   float64 // round trip to the first response byte, in ms
+	Connect float64 // TCP connect time in ms (0 if the connection was reused)
+	TLS     float64 // TLS handshake time in ms (0 for plain HTTP or reused connections)
+	Process float64 // server-side processing time in ms (Total minus Connect and TLS)
 }
 
-// pingTest performs a ping test
-func (c *Client) pingTest() (float64, float64, error) {
-	var pings []float64
+// pingTest performs a ping test against the given server, using HTTP HEAD
+// requests where supported. It reports the minimum observed RTT rather than
+// the mean, since that's less sensitive to occasional scheduling spikes, and
+// jitter as the mean absolute deviation between consecutive samples. The raw
+// per-sample breakdown is also returned for callers that want detail.
+func (c *Client) pingTest(ctx context.Context, server *Server) (minPing, jitter float64, samples []PingSample, err error) {
 	iterations := 5
 
-	for i := 0; i < iterations; i++ {
-		start := time.Now()
+	pingURL := server.urlFor(server.PingURL)
+	method := http.MethodHead
 
-		resp, err := c.httpClient.Get(fmt.Sprintf("%s/empty", c.baseURL))
+	for i := 0; i < iterations; i++ {
+		sample, status, err := c.pingSample(ctx, method, pingURL)
 		if err != nil {
-			return 0, 0, err
+			return 0, 0, nil, err
+		}
+
+		if status == http.StatusMethodNotAllowed && method == http.MethodHead {
+			// The backend doesn't support HEAD; fall back to GET for the rest of the test.
+			method = http.MethodGet
+			sample, status, err = c.pingSample(ctx, method, pingURL)
+			if err != nil {
+				return 0, 0, nil, err
+			}
 		}
-		resp.Body.Close()
 
-		if resp.StatusCode != http.StatusOK {
-			return 0, 0, fmt.Errorf("ping test failed with status: %d", resp.StatusCode)
+		if status != http.StatusOK {
+			return 0, 0, nil, fmt.Errorf("ping test failed with status: %d", status)
 		}
 
-		ping := float64(time.Since(start).Microseconds()) / 1000.0 // Convert to ms
-		pings = append(pings, ping)
+		samples = append(samples, sample)
 
 		// Small delay between pings
 		time.Sleep(100 * time.Millisecond)
 	}
 
-	// Calculate average ping
-	var sum float64
-	for _, ping := range pings {
-		sum += ping
+	minPing = math.Inf(1)
+	for _, s := range samples {
+		if s.Total < minPing {
+			minPing = s.Total
+		}
+	}
+
+	// Jitter as mean absolute deviation between consecutive samples, matching
+	// the algorithm used by the librespeed web client.
+	var madSum float64
+	for i := 1; i < len(samples); i++ {
+		madSum += math.Abs(samples[i].Total - samples[i-1].Total)
+	}
+	if len(samples) > 1 {
+		jitter = madSum / float64(len(samples)-1)
+	}
+
+	return minPing, jitter, samples, nil
+}
+
+// pingSample issues a single timed request to url using method, tracing its
+// connection lifecycle to separate TCP connect, TLS handshake, and server
+// processing time. It returns the response status code alongside the sample
+// so callers can detect a method-not-allowed response and retry with GET.
+func (c *Client) pingSample(ctx context.Context, method, url string) (PingSample, int, error) {
+	var connectStart, connectDone, tlsStart, tlsDone, gotFirstByte time.Time
+
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return PingSample{}, 0, err
+	}
+
+	trace := &httptrace.ClientTrace{
+		ConnectStart:         func(network, addr string) { connectStart = time.Now() },
+		ConnectDone:          func(network, addr string, err error) { connectDone = time.Now() },
+		TLSHandshakeStart:    func() { tlsStart = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { tlsDone = time.Now() },
+		GotFirstResponseByte: func() { gotFirstByte = time.Now() },
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	start := time.Now()
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return PingSample{}, 0, err
+	}
+	resp.Body.Close()
+
+	if gotFirstByte.IsZero() {
+		gotFirstByte = time.Now()
 	}
-	avgPing := sum / float64(len(pings))
 
-	// Calculate jitter (standard deviation of pings)
-	var variance float64
-	for _, ping := range pings {
-		variance += math.Pow(ping-avgPing, 2)
+	sample := PingSample{Total: gotFirstByte.Sub(start).Seconds() * 1000}
+	if !connectStart.IsZero() && !connectDone.IsZero() {
+		sample.Connect = connectDone.Sub(connectStart).Seconds() * 1000
+	}
+	if !tlsStart.IsZero() && !tlsDone.IsZero() {
+		sample.TLS = tlsDone.Sub(tlsStart).Seconds() * 1000
+	}
+	sample.Process = sample.Total - sample.Connect - sample.TLS
+	if sample.Process < 0 {
+		sample.Process = sample.Total
 	}
-	jitter := math.Sqrt(variance / float64(len(pings)))
 
-	return avgPing, jitter, nil
+	return sample, resp.StatusCode, nil
 }
 
-// getIPInfo retrieves IP and ISP information
-func (c *Client) getIPInfo() (*IPInfo, error) {
-	resp, err := c.httpClient.Get(fmt.Sprintf("%s/getIP?isp=true", c.baseURL))
+// getIPInfo retrieves IP and ISP information from the given server
+func (c *Client) getIPInfo(ctx context.Context, server *Server) (*IPInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s?isp=true", server.urlFor(server.GetIPURL)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -217,10 +801,109 @@ type IPInfo struct {
 	} `json:"rawIspInfo"`
 }
 
+// TelemetryLevel mirrors librespeed's telemetry_level setting, controlling
+// how much detail SubmitTelemetry includes in the submitted result.
+type TelemetryLevel string
+
+const (
+	TelemetryBasic    TelemetryLevel = "basic"    // submit summary stats only
+	TelemetryFull     TelemetryLevel = "full"     // also submit the per-phase log
+	TelemetryDisabled TelemetryLevel = "disabled" // don't submit anything
+)
+
+// TelemetryOptions configures a SubmitTelemetry call.
+type TelemetryOptions struct {
+	Level     TelemetryLevel // defaults to TelemetryBasic if empty
+	UserAgent string         // sent as the User-Agent header, if set
+	Referrer  string         // sent as the Referer header, if set
+}
+
+// SubmitTelemetry posts a completed test result to a librespeed results
+// backend's telemetry.php endpoint and returns the URL of the shared result
+// page. telemetryURL is the full URL of that endpoint, e.g.
+// "https://example.com/results/telemetry.php". With TelemetryDisabled nothing
+// is sent and it returns an empty string and a nil error.
+//
+// Note that the "log" field sent with TelemetryFull is a JSON encoding of
+// this package's own TelemetrySample slice, not upstream librespeed's
+// internal log format, so a stock results page will not render throughput
+// graphs from it the way it does for the official JS/CLI clients.
+func (c *Client) SubmitTelemetry(ctx context.Context, telemetryURL string, result *Result, opts TelemetryOptions) (string, error) {
+	if opts.Level == "" {
+		opts.Level = TelemetryBasic
+	}
+	if opts.Level == TelemetryDisabled {
+		return "", nil
+	}
+
+	form := url.Values{}
+	form.Set("ispinfo", fmt.Sprintf("%s - %s", result.ISP, result.IP))
+	form.Set("dl", fmt.Sprintf("%.2f", result.DownloadSpeed))
+	form.Set("ul", fmt.Sprintf("%.2f", result.UploadSpeed))
+	form.Set("ping", fmt.Sprintf("%.2f", result.Ping))
+	form.Set("jitter", fmt.Sprintf("%.2f", result.Jitter))
+	form.Set("extra", "")
+	form.Set("log", "")
+
+	if opts.Level == TelemetryFull {
+		logJSON, err := json.Marshal(result.Log)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode telemetry log: %w", err)
+		}
+		form.Set("log", string(logJSON))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, telemetryURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("failed to build telemetry request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if opts.UserAgent != "" {
+		req.Header.Set("User-Agent", opts.UserAgent)
+	}
+	if opts.Referrer != "" {
+		req.Header.Set("Referer", opts.Referrer)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to submit telemetry: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("telemetry submission failed with status: %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read telemetry response: %w", err)
+	}
+
+	return shareURLFromResponse(telemetryURL, string(body))
+}
+
+// shareURLFromResponse parses telemetry.php's "id=<id>" response body into a
+// share URL pointing at the results page alongside the telemetry endpoint.
+func shareURLFromResponse(telemetryURL, body string) (string, error) {
+	body = strings.TrimSpace(body)
+	id := strings.TrimPrefix(body, "id=")
+	if id == body {
+		return "", fmt.Errorf("unexpected telemetry response: %q", body)
+	}
+
+	dir := telemetryURL
+	if idx := strings.LastIndex(dir, "/"); idx != -1 {
+		dir = dir[:idx+1]
+	}
+
+	return fmt.Sprintf("%s?id=%s", dir, id), nil
+}
+
 // Example usage:
 func main() {
 	client := NewClient("http://localhost:8989")
-	result, err := client.RunTest()
+	result, err := client.RunTest(context.Background(), nil, DefaultTestConfig())
 	if err != nil {
 		fmt.Printf("Speed test failed: %v\n", err)
 		return